@@ -2,8 +2,8 @@
 package autorc
 
 import (
+	"context"
 	"io"
-	"log"
 	"net"
 	"time"
 
@@ -40,11 +40,43 @@ type Conn struct {
 	Raw mysql.Conn
 	// Maximum reconnect retries.
 	// Default is 7 which means 1+2+3+4+5+6+7 = 28 seconds before return error
-	// (if waiting for error takes no time).
+	// (if waiting for error takes no time), unless Backoff is set to
+	// something other than the default LinearBackoff.
 	MaxRetries int
 
-	// Debug logging. You may change it at any time.
+	// Backoff controls the delay between reconnect attempts. Defaults to
+	// LinearBackoff, reproducing the historical MaxRetries behavior above.
+	Backoff BackoffPolicy
+
+	// MaxElapsed bounds the total wall-clock time of each call, counted
+	// from its start and including any retries, regardless of MaxRetries.
+	// In the *Context methods it also aborts an operation still in flight
+	// when the budget runs out. Zero means no wall-clock limit.
+	MaxElapsed time.Duration
+
+	// IsNetErr, if set, overrides the package-level IsNetErr used to
+	// decide whether an error should trigger a reconnect, so callers can
+	// classify additional errors (e.g. lock wait timeouts) as retryable.
+	IsNetErr func(error) bool
+
+	// RetryMode controls which statements are safe to silently re-run
+	// after a net error. Defaults to RetryAlways, the historical autorc
+	// behavior.
+	RetryMode RetryMode
+
+	// CheckFn is consulted by RetrySafe to tell whether a non-idempotent
+	// statement committed before the connection dropped. See RetrySafe.
+	CheckFn CheckFn
+
+	// Debug logging. You may change it at any time. Ignored once Observer
+	// is set.
 	Debug bool
+
+	// Observer, if set, receives reconnect/retry/query lifecycle events
+	// in place of the Debug logging above.
+	Observer Observer
+
+	session *sessionState
 }
 
 // New creates a new autoreconnecting connection.
@@ -62,7 +94,7 @@ func NewFromCF(cfgFile string) (*Conn, map[string]string, error) {
 	if err != nil {
 		return nil, nil, err
 	}
-	return &Conn{raw, 7, false}, unk, nil
+	return &Conn{Raw: raw, MaxRetries: 7}, unk, nil
 }
 
 // Clone makes a copy of the connection.
@@ -70,7 +102,13 @@ func (c *Conn) Clone() *Conn {
 	return &Conn{
 		Raw:        c.Raw.Clone(),
 		MaxRetries: c.MaxRetries,
+		Backoff:    c.Backoff,
+		MaxElapsed: c.MaxElapsed,
+		IsNetErr:   c.IsNetErr,
+		RetryMode:  c.RetryMode,
+		CheckFn:    c.CheckFn,
 		Debug:      c.Debug,
+		Observer:   c.Observer,
 	}
 }
 
@@ -79,35 +117,88 @@ func (c *Conn) SetTimeout(timeout time.Duration) {
 	c.Raw.SetTimeout(timeout)
 }
 
-func (c *Conn) reconnectIfNetErr(nn *int, err *error) {
-	for *err != nil && IsNetErr(*err) && *nn <= c.MaxRetries {
-		if c.Debug {
-			log.Printf("Error: '%s' - reconnecting...", *err)
+// isNetErr reports whether err should trigger a reconnect, using c.IsNetErr
+// if the caller has overridden it and falling back to the package-level
+// IsNetErr otherwise.
+func (c *Conn) isNetErr(err error) bool {
+	if c.IsNetErr != nil {
+		return c.IsNetErr(err)
+	}
+	return IsNetErr(err)
+}
+
+// backoffPolicy returns c.Backoff, defaulting to LinearBackoff so the
+// historical MaxRetries-seconds behavior holds when Backoff is unset.
+func (c *Conn) backoffPolicy() BackoffPolicy {
+	if c.Backoff != nil {
+		return c.Backoff
+	}
+	return LinearBackoff{}
+}
+
+// withDeadline bounds ctx by MaxElapsed, if set, so a retry loop gives up
+// after a wall-clock budget regardless of MaxRetries.
+func (c *Conn) withDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.MaxElapsed <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, c.MaxElapsed)
+}
+
+// reconnectIfNetErr retries c.Raw.Reconnect while *err is a network error,
+// waiting between attempts as directed by c.Backoff, up to MaxRetries. ctx
+// is checked before sleeping and while sleeping so a canceled context (or an
+// elapsed MaxElapsed deadline) stops the loop immediately instead of
+// sleeping through the remaining retry budget.
+func (c *Conn) reconnectIfNetErr(ctx context.Context, nn *int, err *error) {
+	for *err != nil && c.isNetErr(*err) && *nn <= c.MaxRetries {
+		if ctx.Err() != nil {
+			*err = ctx.Err()
+			return
+		}
+		delay, ok := c.backoffPolicy().NextDelay(*nn, *err)
+		if !ok {
+			return
+		}
+		c.observer().OnReconnectAttempt(*nn, *err)
+		attemptStart := time.Now()
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			*err = ctx.Err()
+			return
 		}
-		time.Sleep(time.Second * time.Duration(*nn))
 		*err = c.Raw.Reconnect()
-		if c.Debug && *err != nil {
-			log.Println("Can't reconnect:", *err)
+		if *err == nil {
+			*err = c.replaySession()
+		}
+		if *err == nil {
+			c.observer().OnReconnectSuccess(*nn, time.Since(attemptStart))
 		}
 		*nn++
 	}
 }
 
-func (c *Conn) connectIfNotConnected() (err error) {
+func (c *Conn) connectIfNotConnected(ctx context.Context) (err error) {
 	if c.Raw.IsConnected() {
 		return
 	}
 	err = c.Raw.Connect()
 	nn := 0
-	c.reconnectIfNetErr(&nn, &err)
+	c.reconnectIfNetErr(ctx, &nn, &err)
 	return
 }
 
 // Reconnect tries to reconnect the connection up to MaxRetries times.
 func (c *Conn) Reconnect() (err error) {
+	ctx, cancel := c.withDeadline(context.Background())
+	defer cancel()
 	err = c.Raw.Reconnect()
+	if err == nil {
+		err = c.replaySession()
+	}
 	nn := 0
-	c.reconnectIfNetErr(&nn, &err)
+	c.reconnectIfNetErr(ctx, &nn, &err)
 	return
 }
 
@@ -120,16 +211,23 @@ func (c *Conn) SetMaxPktSize(new_size int) int {
 }
 
 // Use is an automatic connect/reconnect/repeat version of mysql.Conn.Use.
-func (c *Conn) Use(dbname string) (err error) {
-	if err = c.connectIfNotConnected(); err != nil {
+func (c *Conn) Use(dbname string) error {
+	ctx, cancel := c.withDeadline(context.Background())
+	defer cancel()
+	return c.useCtx(ctx, dbname)
+}
+
+func (c *Conn) useCtx(ctx context.Context, dbname string) (err error) {
+	if err = c.connectIfNotConnected(ctx); err != nil {
 		return
 	}
 	nn := 0
 	for {
 		if err = c.Raw.Use(dbname); err == nil {
+			c.recordUse(dbname)
 			return
 		}
-		if c.reconnectIfNetErr(&nn, &err); err != nil {
+		if c.reconnectIfNetErr(ctx, &nn, &err); err != nil {
 			return
 		}
 	}
@@ -138,8 +236,16 @@ func (c *Conn) Use(dbname string) (err error) {
 
 // Query is an automatic connect/reconnect/repeat version of mysql.Conn.Query.
 func (c *Conn) Query(sql string, params ...interface{}) (rows []mysql.Row, res mysql.Result, err error) {
+	ctx, cancel := c.withDeadline(context.Background())
+	defer cancel()
+	return c.queryCtx(ctx, sql, params...)
+}
+
+func (c *Conn) queryCtx(ctx context.Context, sql string, params ...interface{}) (rows []mysql.Row, res mysql.Result, err error) {
+	start := time.Now()
+	defer func() { c.observer().OnQuery(sql, time.Since(start), err) }()
 
-	if err = c.connectIfNotConnected(); err != nil {
+	if err = c.connectIfNotConnected(ctx); err != nil {
 		return
 	}
 	nn := 0
@@ -147,17 +253,33 @@ func (c *Conn) Query(sql string, params ...interface{}) (rows []mysql.Row, res m
 		if rows, res, err = c.Raw.Query(sql, params...); err == nil {
 			return
 		}
-		if c.reconnectIfNetErr(&nn, &err); err != nil {
+		wasNetErr := c.isNetErr(err)
+		c.observer().OnRetry("Query", sql, nn, err)
+		if c.reconnectIfNetErr(ctx, &nn, &err); err != nil {
 			return
 		}
+		if wasNetErr {
+			switch c.retryAllowed(sql, false) {
+			case retryUnsafe:
+				err = ErrRetryUnsafe
+				return
+			case retryAlreadyCommitted:
+				err = ErrAlreadyCommitted
+				return
+			}
+		}
 	}
 	panic(nil)
 }
 
 // QueryFirst is an automatic connect/reconnect/repeat version of mysql.Conn.QueryFirst.
 func (c *Conn) QueryFirst(sql string, params ...interface{}) (row mysql.Row, res mysql.Result, err error) {
+	ctx, cancel := c.withDeadline(context.Background())
+	defer cancel()
+	start := time.Now()
+	defer func() { c.observer().OnQuery(sql, time.Since(start), err) }()
 
-	if err = c.connectIfNotConnected(); err != nil {
+	if err = c.connectIfNotConnected(ctx); err != nil {
 		return
 	}
 	nn := 0
@@ -165,17 +287,33 @@ func (c *Conn) QueryFirst(sql string, params ...interface{}) (row mysql.Row, res
 		if row, res, err = c.Raw.QueryFirst(sql, params...); err == nil {
 			return
 		}
-		if c.reconnectIfNetErr(&nn, &err); err != nil {
+		wasNetErr := c.isNetErr(err)
+		c.observer().OnRetry("QueryFirst", sql, nn, err)
+		if c.reconnectIfNetErr(ctx, &nn, &err); err != nil {
 			return
 		}
+		if wasNetErr {
+			switch c.retryAllowed(sql, false) {
+			case retryUnsafe:
+				err = ErrRetryUnsafe
+				return
+			case retryAlreadyCommitted:
+				err = ErrAlreadyCommitted
+				return
+			}
+		}
 	}
 	panic(nil)
 }
 
 // QueryLast is an automatic connect/reconnect/repeat version of mysql.Conn.QueryLast.
 func (c *Conn) QueryLast(sql string, params ...interface{}) (row mysql.Row, res mysql.Result, err error) {
+	ctx, cancel := c.withDeadline(context.Background())
+	defer cancel()
+	start := time.Now()
+	defer func() { c.observer().OnQuery(sql, time.Since(start), err) }()
 
-	if err = c.connectIfNotConnected(); err != nil {
+	if err = c.connectIfNotConnected(ctx); err != nil {
 		return
 	}
 	nn := 0
@@ -183,9 +321,21 @@ func (c *Conn) QueryLast(sql string, params ...interface{}) (row mysql.Row, res
 		if row, res, err = c.Raw.QueryLast(sql, params...); err == nil {
 			return
 		}
-		if c.reconnectIfNetErr(&nn, &err); err != nil {
+		wasNetErr := c.isNetErr(err)
+		c.observer().OnRetry("QueryLast", sql, nn, err)
+		if c.reconnectIfNetErr(ctx, &nn, &err); err != nil {
 			return
 		}
+		if wasNetErr {
+			switch c.retryAllowed(sql, false) {
+			case retryUnsafe:
+				err = ErrRetryUnsafe
+				return
+			case retryAlreadyCommitted:
+				err = ErrAlreadyCommitted
+				return
+			}
+		}
 	}
 	panic(nil)
 }
@@ -200,15 +350,25 @@ type Stmt struct {
 	Raw mysql.Stmt
 	con *Conn
 
+	// Idempotent marks this statement as safe to silently re-run after a
+	// net error even when its Conn's RetryMode is RetrySafe.
+	Idempotent bool
+
 	sql string
 }
 
 // PrepareOnce prepares a statement if it wasn't prepared before.
 func (c *Conn) PrepareOnce(s *Stmt, sql string) error {
+	ctx, cancel := c.withDeadline(context.Background())
+	defer cancel()
+	return c.prepareOnceCtx(ctx, s, sql)
+}
+
+func (c *Conn) prepareOnceCtx(ctx context.Context, s *Stmt, sql string) error {
 	if s.Raw != nil {
 		return nil
 	}
-	if err := c.connectIfNotConnected(); err != nil {
+	if err := c.connectIfNotConnected(ctx); err != nil {
 		return err
 	}
 	nn := 0
@@ -216,9 +376,10 @@ func (c *Conn) PrepareOnce(s *Stmt, sql string) error {
 		var err error
 		if s.Raw, err = c.Raw.Prepare(sql); err == nil {
 			s.con = c
+			c.trackStmt(s)
 			return nil
 		}
-		if c.reconnectIfNetErr(&nn, &err); err != nil {
+		if c.reconnectIfNetErr(ctx, &nn, &err); err != nil {
 			return err
 		}
 	}
@@ -227,19 +388,29 @@ func (c *Conn) PrepareOnce(s *Stmt, sql string) error {
 
 // Prepare is an automatic connect/reconnect/repeat version of mysql.Conn.Prepare.
 func (c *Conn) Prepare(sql string) (*Stmt, error) {
+	ctx, cancel := c.withDeadline(context.Background())
+	defer cancel()
+	return c.prepareCtx(ctx, sql)
+}
+
+func (c *Conn) prepareCtx(ctx context.Context, sql string) (*Stmt, error) {
 	var s Stmt
 	s.sql = sql
-	if err := c.PrepareOnce(&s, sql); err != nil {
+	if err := c.prepareOnceCtx(ctx, &s, sql); err != nil {
 		return nil, err
 	}
 	return &s, nil
 }
 
-func (c *Conn) reprepare(stmt *Stmt) error {
+func (c *Conn) reprepare(ctx context.Context, stmt *Stmt) error {
 	sql := stmt.sql
 	stmt.Raw = nil
 
-	return c.PrepareOnce(stmt, sql)
+	if err := c.prepareOnceCtx(ctx, stmt, sql); err != nil {
+		return err
+	}
+	c.observer().OnRepreparedStmt(sql)
+	return nil
 }
 
 // Begin starts a transaction and calls f to complete it.
@@ -247,7 +418,13 @@ func (c *Conn) reprepare(stmt *Stmt) error {
 // f up to MaxRetries times. If error is of type *mysql.Error it tries to rollback
 // the transaction.
 func (c *Conn) Begin(f func(mysql.Transaction, ...interface{}) error, args ...interface{}) error {
-	err := c.connectIfNotConnected()
+	ctx, cancel := c.withDeadline(context.Background())
+	defer cancel()
+	return c.beginCtx(ctx, f, args...)
+}
+
+func (c *Conn) beginCtx(ctx context.Context, f func(mysql.Transaction, ...interface{}) error, args ...interface{}) error {
+	err := c.connectIfNotConnected(ctx)
 	if err != nil {
 		return err
 	}
@@ -259,7 +436,7 @@ func (c *Conn) Begin(f func(mysql.Transaction, ...interface{}) error, args ...in
 				return nil
 			}
 		}
-		if c.reconnectIfNetErr(&nn, &err); err != nil {
+		if c.reconnectIfNetErr(ctx, &nn, &err); err != nil {
 			if _, ok := err.(*mysql.Error); ok && tr.IsValid() {
 				tr.Rollback()
 			}
@@ -274,6 +451,17 @@ func (s *Stmt) Bind(params ...interface{}) {
 	s.Raw.Bind(params...)
 }
 
+// Close releases s from its Conn's tracked statement set, so it is no
+// longer re-prepared after a future reconnect. Statements kept for the life
+// of a Conn don't need this; call it for statements prepared for a single
+// use, such as Pool.Exec's per-call Prepare, to avoid growing the tracked
+// set without bound.
+func (s *Stmt) Close() {
+	if s.con != nil {
+		s.con.untrackStmt(s)
+	}
+}
+
 func (s *Stmt) needsRepreparing(err error) bool {
 	if mysqlErr, ok := err.(*mysql.Error); ok {
 		if mysqlErr.Code == mysql.ER_UNKNOWN_STMT_HANDLER {
@@ -286,8 +474,16 @@ func (s *Stmt) needsRepreparing(err error) bool {
 
 // Exec is an automatic connect/reconnect/repeat version of mysql.Stmt.Exec.
 func (s *Stmt) Exec(params ...interface{}) (rows []mysql.Row, res mysql.Result, err error) {
+	ctx, cancel := s.con.withDeadline(context.Background())
+	defer cancel()
+	return s.execCtx(ctx, params...)
+}
+
+func (s *Stmt) execCtx(ctx context.Context, params ...interface{}) (rows []mysql.Row, res mysql.Result, err error) {
+	start := time.Now()
+	defer func() { s.con.observer().OnQuery(s.sql, time.Since(start), err) }()
 
-	if err = s.con.connectIfNotConnected(); err != nil {
+	if err = s.con.connectIfNotConnected(ctx); err != nil {
 		return
 	}
 	nn := 0
@@ -297,7 +493,7 @@ func (s *Stmt) Exec(params ...interface{}) (rows []mysql.Row, res mysql.Result,
 		}
 
 		if s.needsRepreparing(err) {
-			if s.con.reprepare(s) != nil {
+			if s.con.reprepare(ctx, s) != nil {
 				return
 			}
 
@@ -305,17 +501,33 @@ func (s *Stmt) Exec(params ...interface{}) (rows []mysql.Row, res mysql.Result,
 			continue
 		}
 
-		if s.con.reconnectIfNetErr(&nn, &err); err != nil {
+		wasNetErr := s.con.isNetErr(err)
+		s.con.observer().OnRetry("Exec", s.sql, nn, err)
+		if s.con.reconnectIfNetErr(ctx, &nn, &err); err != nil {
 			return
 		}
+		if wasNetErr {
+			switch s.con.retryAllowed(s.sql, s.Idempotent) {
+			case retryUnsafe:
+				err = ErrRetryUnsafe
+				return
+			case retryAlreadyCommitted:
+				err = ErrAlreadyCommitted
+				return
+			}
+		}
 	}
 	panic(nil)
 }
 
 // ExecFirst is an automatic connect/reconnect/repeat version of mysql.Stmt.ExecFirst.
 func (s *Stmt) ExecFirst(params ...interface{}) (row mysql.Row, res mysql.Result, err error) {
+	ctx, cancel := s.con.withDeadline(context.Background())
+	defer cancel()
+	start := time.Now()
+	defer func() { s.con.observer().OnQuery(s.sql, time.Since(start), err) }()
 
-	if err = s.con.connectIfNotConnected(); err != nil {
+	if err = s.con.connectIfNotConnected(ctx); err != nil {
 		return
 	}
 	nn := 0
@@ -325,7 +537,7 @@ func (s *Stmt) ExecFirst(params ...interface{}) (row mysql.Row, res mysql.Result
 		}
 
 		if s.needsRepreparing(err) {
-			if s.con.reprepare(s) != nil {
+			if s.con.reprepare(ctx, s) != nil {
 				return
 			}
 
@@ -333,17 +545,33 @@ func (s *Stmt) ExecFirst(params ...interface{}) (row mysql.Row, res mysql.Result
 			continue
 		}
 
-		if s.con.reconnectIfNetErr(&nn, &err); err != nil {
+		wasNetErr := s.con.isNetErr(err)
+		s.con.observer().OnRetry("ExecFirst", s.sql, nn, err)
+		if s.con.reconnectIfNetErr(ctx, &nn, &err); err != nil {
 			return
 		}
+		if wasNetErr {
+			switch s.con.retryAllowed(s.sql, s.Idempotent) {
+			case retryUnsafe:
+				err = ErrRetryUnsafe
+				return
+			case retryAlreadyCommitted:
+				err = ErrAlreadyCommitted
+				return
+			}
+		}
 	}
 	panic(nil)
 }
 
 // ExecLast is an automatic connect/reconnect/repeat version of mysql.Stmt.ExecLast.
 func (s *Stmt) ExecLast(params ...interface{}) (row mysql.Row, res mysql.Result, err error) {
+	ctx, cancel := s.con.withDeadline(context.Background())
+	defer cancel()
+	start := time.Now()
+	defer func() { s.con.observer().OnQuery(s.sql, time.Since(start), err) }()
 
-	if err = s.con.connectIfNotConnected(); err != nil {
+	if err = s.con.connectIfNotConnected(ctx); err != nil {
 		return
 	}
 	nn := 0
@@ -353,7 +581,7 @@ func (s *Stmt) ExecLast(params ...interface{}) (row mysql.Row, res mysql.Result,
 		}
 
 		if s.needsRepreparing(err) {
-			if s.con.reprepare(s) != nil {
+			if s.con.reprepare(ctx, s) != nil {
 				return
 			}
 
@@ -361,9 +589,21 @@ func (s *Stmt) ExecLast(params ...interface{}) (row mysql.Row, res mysql.Result,
 			continue
 		}
 
-		if s.con.reconnectIfNetErr(&nn, &err); err != nil {
+		wasNetErr := s.con.isNetErr(err)
+		s.con.observer().OnRetry("ExecLast", s.sql, nn, err)
+		if s.con.reconnectIfNetErr(ctx, &nn, &err); err != nil {
 			return
 		}
+		if wasNetErr {
+			switch s.con.retryAllowed(s.sql, s.Idempotent) {
+			case retryUnsafe:
+				err = ErrRetryUnsafe
+				return
+			case retryAlreadyCommitted:
+				err = ErrAlreadyCommitted
+				return
+			}
+		}
 	}
 	panic(nil)
 }
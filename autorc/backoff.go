@@ -0,0 +1,74 @@
+package autorc
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// BackoffPolicy controls how long reconnectIfNetErr waits between reconnect
+// attempts. NextDelay is given the current attempt number (0-based, matching
+// the historical nn counter) and the error that triggered the reconnect, and
+// returns the delay to wait and whether to retry at all; returning ok=false
+// stops the retry loop even if MaxRetries hasn't been reached yet.
+type BackoffPolicy interface {
+	NextDelay(attempt int, err error) (delay time.Duration, ok bool)
+}
+
+// LinearBackoff reproduces the historical behavior of autorc: wait attempt
+// seconds before the next reconnect (0s, 1s, 2s, ...).
+type LinearBackoff struct{}
+
+// NextDelay implements BackoffPolicy.
+func (LinearBackoff) NextDelay(attempt int, err error) (time.Duration, bool) {
+	return time.Second * time.Duration(attempt), true
+}
+
+// ExponentialBackoff waits Base*Multiplier^attempt, capped at Max (no cap if
+// Max is zero). Multiplier defaults to 2 when zero, since a zero Multiplier
+// would give "Base once, then a hot reconnect loop". Any other value is used
+// as given, so a Multiplier of 1 or less never grows the delay.
+type ExponentialBackoff struct {
+	Base       time.Duration
+	Max        time.Duration
+	Multiplier float64
+}
+
+// NextDelay implements BackoffPolicy.
+func (b ExponentialBackoff) NextDelay(attempt int, err error) (time.Duration, bool) {
+	return b.delay(attempt), true
+}
+
+func (b ExponentialBackoff) delay(attempt int) time.Duration {
+	mult := b.Multiplier
+	if mult == 0 {
+		mult = 2
+	}
+	d := float64(b.Base) * math.Pow(mult, float64(attempt))
+	if b.Max > 0 && d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	if d < 0 {
+		d = 0
+	}
+	return time.Duration(d)
+}
+
+// ExponentialJitterBackoff is ExponentialBackoff with full jitter applied:
+// sleep = rand(0, min(Max, Base*Multiplier^attempt)). This spreads out
+// reconnects from many clients recovering from the same MySQL restart
+// instead of having them all retry in lockstep.
+type ExponentialJitterBackoff struct {
+	Base       time.Duration
+	Max        time.Duration
+	Multiplier float64
+}
+
+// NextDelay implements BackoffPolicy.
+func (b ExponentialJitterBackoff) NextDelay(attempt int, err error) (time.Duration, bool) {
+	max := ExponentialBackoff(b).delay(attempt)
+	if max <= 0 {
+		return 0, true
+	}
+	return time.Duration(rand.Int63n(int64(max) + 1)), true
+}
@@ -0,0 +1,38 @@
+package autorc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExponentialBackoffDefaultMultiplier(t *testing.T) {
+	b := ExponentialBackoff{Base: time.Second}
+	cases := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{3, 8 * time.Second},
+	}
+	for _, c := range cases {
+		if got := b.delay(c.attempt); got != c.want {
+			t.Errorf("delay(%d) = %v, want %v", c.attempt, got, c.want)
+		}
+	}
+}
+
+func TestExponentialBackoffCapsAtMax(t *testing.T) {
+	b := ExponentialBackoff{Base: time.Second, Multiplier: 2, Max: 5 * time.Second}
+	if got := b.delay(10); got != 5*time.Second {
+		t.Errorf("delay(10) = %v, want %v", got, 5*time.Second)
+	}
+}
+
+func TestExponentialBackoffExplicitMultiplier(t *testing.T) {
+	b := ExponentialBackoff{Base: time.Second, Multiplier: 3}
+	if got := b.delay(2); got != 9*time.Second {
+		t.Errorf("delay(2) = %v, want %v", got, 9*time.Second)
+	}
+}
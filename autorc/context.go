@@ -0,0 +1,118 @@
+package autorc
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ziutek/mymysql/mysql"
+)
+
+// watch starts a goroutine that aborts the operation on c by closing the
+// underlying connection as soon as ctx is done, forcing Raw out of whatever
+// blocking read or write it is stuck in. The returned stop func must be
+// called once the operation finishes so the goroutine can exit even if ctx
+// is never canceled.
+//
+// Unlike database/sql drivers, which close only the underlying net.Conn and
+// leave the driver's own buffers alone, mysql.Conn has no net.Conn accessor
+// and isn't documented as safe for concurrent use: this Close necessarily
+// runs concurrently with whatever Raw method the watched operation is
+// blocked in. That's a known, accepted race - the alternative is not being
+// able to interrupt a connection stuck in a blocking read/write at all - but
+// it means a canceled ctx can leave c.Raw's internal state torn; the next
+// call on c finds Raw closed and opens it again with Raw.Connect, so this is
+// only safe because callers are expected to stop using c.Raw directly once
+// its context is done. That fresh Connect does not replay the session state
+// recorded by Use, Set, Prepare and OnReconnect; only a reconnect after a
+// net error does.
+func (c *Conn) watch(ctx context.Context) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	closech := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Raw.Close()
+		case <-closech:
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(closech) }) }
+}
+
+// ctxErr reports ctx.Err() in place of err once ctx has been canceled, so
+// callers see context.Canceled/DeadlineExceeded rather than whatever network
+// error the watcher's forced Close happened to produce.
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// UseContext is a context-aware version of Use. The operation is aborted,
+// and the reconnect loop stopped, as soon as ctx is done.
+func (c *Conn) UseContext(ctx context.Context, dbname string) error {
+	ctx, cancel := c.withDeadline(ctx)
+	defer cancel()
+	stop := c.watch(ctx)
+	defer stop()
+	return ctxErr(ctx, c.useCtx(ctx, dbname))
+}
+
+// QueryContext is a context-aware version of Query.
+func (c *Conn) QueryContext(ctx context.Context, sql string, params ...interface{}) (rows []mysql.Row, res mysql.Result, err error) {
+	ctx, cancel := c.withDeadline(ctx)
+	defer cancel()
+	stop := c.watch(ctx)
+	defer stop()
+	rows, res, err = c.queryCtx(ctx, sql, params...)
+	err = ctxErr(ctx, err)
+	return
+}
+
+// PrepareContext is a context-aware version of Prepare.
+func (c *Conn) PrepareContext(ctx context.Context, sql string) (*Stmt, error) {
+	ctx, cancel := c.withDeadline(ctx)
+	defer cancel()
+	stop := c.watch(ctx)
+	defer stop()
+	s, err := c.prepareCtx(ctx, sql)
+	return s, ctxErr(ctx, err)
+}
+
+// BeginContext is a context-aware version of Begin.
+func (c *Conn) BeginContext(ctx context.Context, f func(mysql.Transaction, ...interface{}) error, args ...interface{}) error {
+	ctx, cancel := c.withDeadline(ctx)
+	defer cancel()
+	stop := c.watch(ctx)
+	defer stop()
+	return ctxErr(ctx, c.beginCtx(ctx, f, args...))
+}
+
+// ExecContext is a context-aware version of Stmt.Exec.
+func (s *Stmt) ExecContext(ctx context.Context, params ...interface{}) (rows []mysql.Row, res mysql.Result, err error) {
+	ctx, cancel := s.con.withDeadline(ctx)
+	defer cancel()
+	stop := s.con.watch(ctx)
+	defer stop()
+	rows, res, err = s.execCtx(ctx, params...)
+	err = ctxErr(ctx, err)
+	return
+}
+
+// KillQuery aborts a query that is stuck on the server rather than on the
+// network, where closing the client socket alone won't interrupt it. It
+// opens a side connection cloned from c and issues KILL QUERY against c's
+// connection id. Intended as a fallback to pair with a canceled context,
+// e.g. called from the ctx.Done() branch of a caller's own select.
+func (c *Conn) KillQuery() error {
+	killer := c.Clone()
+	if err := killer.Raw.Connect(); err != nil {
+		return err
+	}
+	defer killer.Raw.Close()
+	_, _, err := killer.Raw.Query("KILL QUERY %d", c.Raw.ThreadId())
+	return err
+}
@@ -0,0 +1,52 @@
+package autorc
+
+import (
+	"log"
+	"time"
+)
+
+// Observer receives lifecycle events from a Conn: reconnect attempts and
+// successful reconnects, failed statement attempts, re-prepares, and
+// completed queries. A failed reconnect is not reported on its own.
+// OnRetry is called for every failed Query*/Exec* attempt, before autorc
+// decides whether to reconnect and run it again, so it also reports errors
+// that end up not being retried. It is the extension point for a Prometheus
+// or OpenTelemetry adapter; Conn.Debug is implemented as one of these
+// (logObserver) for backward compatibility.
+type Observer interface {
+	OnReconnectAttempt(attempt int, err error)
+	OnReconnectSuccess(attempt int, elapsed time.Duration)
+	OnRetry(op, sql string, attempt int, err error)
+	OnRepreparedStmt(sql string)
+	OnQuery(sql string, elapsed time.Duration, err error)
+}
+
+// NopObserver implements Observer with no-op methods. Embed it to implement
+// Observer while only overriding the events you care about.
+type NopObserver struct{}
+
+func (NopObserver) OnReconnectAttempt(attempt int, err error)             {}
+func (NopObserver) OnReconnectSuccess(attempt int, elapsed time.Duration) {}
+func (NopObserver) OnRetry(op, sql string, attempt int, err error)        {}
+func (NopObserver) OnRepreparedStmt(sql string)                           {}
+func (NopObserver) OnQuery(sql string, elapsed time.Duration, err error)  {}
+
+// logObserver reproduces autorc's historical Debug log.Printf behavior as
+// an Observer.
+type logObserver struct{ NopObserver }
+
+func (logObserver) OnReconnectAttempt(attempt int, err error) {
+	log.Printf("Error: '%s' - reconnecting...", err)
+}
+
+// observer returns c.Observer, defaulting to logObserver when c.Debug is
+// set (for backward compatibility) and to NopObserver otherwise.
+func (c *Conn) observer() Observer {
+	if c.Observer != nil {
+		return c.Observer
+	}
+	if c.Debug {
+		return logObserver{}
+	}
+	return NopObserver{}
+}
@@ -0,0 +1,372 @@
+package autorc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ziutek/mymysql/mysql"
+)
+
+// ErrPoolClosed is returned by Pool.Get once the pool has been closed.
+var ErrPoolClosed = errors.New("autorc: pool is closed")
+
+// PoolStats reports a Pool's current usage.
+type PoolStats struct {
+	InUse        int
+	Idle         int
+	WaitCount    int64
+	WaitDuration time.Duration
+	Reconnects   int64
+}
+
+// Pool manages a bounded set of *autorc.Conn behind Get/Put, for mymysql
+// users who bypass database/sql - and so don't get its pooling for free -
+// but still want MaxOpen/MaxIdle/MaxLifetime/MaxIdleTime semantics and
+// background health checking of idle connections.
+type Pool struct {
+	// New creates a fresh connection. Required.
+	New func() *Conn
+
+	// MaxOpen limits the number of connections the pool will create.
+	// Zero means unlimited.
+	MaxOpen int
+	// MaxIdle limits the number of idle connections kept around for
+	// reuse. Zero means no idle connections are kept.
+	MaxIdle int
+	// MaxLifetime closes a connection once it has existed this long, the
+	// next time it is returned to the pool via Put or taken from the idle
+	// pool by Get. Zero means no limit.
+	MaxLifetime time.Duration
+	// MaxIdleTime closes a connection that has sat idle this long. Zero
+	// means no limit.
+	MaxIdleTime time.Duration
+	// HealthCheckInterval, if positive, pings idle connections on this
+	// interval in the background and evicts ones failing IsNetErr.
+	HealthCheckInterval time.Duration
+	// ResetSession, if set, runs on a connection before Put returns it to
+	// the idle pool, to discard session-local state (temp tables, user
+	// variables) left over from the previous checkout.
+	ResetSession func(*Conn) error
+
+	mu      sync.Mutex
+	idle    []*poolEntry
+	inUse   map[*Conn]*poolEntry
+	waiters []chan struct{}
+	numOpen int
+	closed  bool
+
+	waitCount    int64
+	waitDuration time.Duration
+	reconnects   int64
+
+	startHealthLoop sync.Once
+	stopHealthLoop  chan struct{}
+}
+
+type poolEntry struct {
+	c          *Conn
+	createdAt  time.Time
+	lastUsedAt time.Time
+}
+
+// NewPool creates a Pool whose connections are created by newConn, with
+// MaxOpen=10 and MaxIdle=2 as a starting point.
+func NewPool(newConn func() *Conn) *Pool {
+	return &Pool{
+		New:     newConn,
+		MaxOpen: 10,
+		MaxIdle: 2,
+		inUse:   make(map[*Conn]*poolEntry),
+	}
+}
+
+func (p *Pool) maxIdle() int {
+	if p.MaxIdle < 0 {
+		return 0
+	}
+	return p.MaxIdle
+}
+
+// newConn creates a connection via p.New and wires a reconnect counter onto
+// it for Stats.
+func (p *Pool) newConn() *Conn {
+	c := p.New()
+	c.OnReconnect(func(mysql.Conn) error {
+		p.mu.Lock()
+		p.reconnects++
+		p.mu.Unlock()
+		return nil
+	})
+	return c
+}
+
+// Get returns a connection from the pool, creating one if MaxOpen allows or
+// waiting for one to be Put back otherwise. It returns ctx.Err() if ctx is
+// done before a connection becomes available.
+func (p *Pool) Get(ctx context.Context) (*Conn, error) {
+	p.ensureHealthLoop()
+
+	p.mu.Lock()
+	for {
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+
+		for len(p.idle) > 0 {
+			e := p.idle[len(p.idle)-1]
+			p.idle = p.idle[:len(p.idle)-1]
+			if p.expiredLocked(e) {
+				p.numOpen--
+				p.mu.Unlock()
+				e.c.Raw.Close()
+				p.mu.Lock()
+				continue
+			}
+			e.lastUsedAt = time.Now()
+			p.inUse[e.c] = e
+			p.mu.Unlock()
+			return e.c, nil
+		}
+
+		if p.MaxOpen <= 0 || p.numOpen < p.MaxOpen {
+			p.numOpen++
+			p.mu.Unlock()
+			c := p.newConn()
+			e := &poolEntry{c: c, createdAt: time.Now()}
+			p.mu.Lock()
+			p.inUse[c] = e
+			p.mu.Unlock()
+			return c, nil
+		}
+
+		wait := make(chan struct{})
+		p.waiters = append(p.waiters, wait)
+		p.waitCount++
+		start := time.Now()
+		p.mu.Unlock()
+
+		select {
+		case <-wait:
+			p.mu.Lock()
+			p.waitDuration += time.Since(start)
+		case <-ctx.Done():
+			p.mu.Lock()
+			p.waitDuration += time.Since(start)
+			if !p.removeWaiterLocked(wait) {
+				// wait was already popped and closed by a concurrent
+				// wakeWaiterLocked - we're not going to use that wake
+				// (we're bailing out via ctx), so forward it to the next
+				// waiter instead of losing the freed slot it represents.
+				p.wakeWaiterLocked()
+			}
+			p.mu.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Put returns c to the pool, running ResetSession first if set. A
+// connection past MaxLifetime, or returned while the idle pool is already
+// at MaxIdle, is closed instead of kept. Put is a no-op for a *Conn not
+// currently checked out of p.
+func (p *Pool) Put(c *Conn) {
+	p.mu.Lock()
+	e, ok := p.inUse[c]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+	delete(p.inUse, c)
+	p.mu.Unlock()
+
+	if p.ResetSession != nil {
+		if err := p.ResetSession(c); err != nil {
+			p.mu.Lock()
+			p.numOpen--
+			p.wakeWaiterLocked()
+			p.mu.Unlock()
+			c.Raw.Close()
+			return
+		}
+	}
+
+	p.mu.Lock()
+	if p.closed || p.pastLifetimeLocked(e) || len(p.idle) >= p.maxIdle() {
+		p.numOpen--
+		p.wakeWaiterLocked()
+		p.mu.Unlock()
+		c.Raw.Close()
+		return
+	}
+	e.lastUsedAt = time.Now()
+	p.idle = append(p.idle, e)
+	p.wakeWaiterLocked()
+	p.mu.Unlock()
+}
+
+func (p *Pool) expiredLocked(e *poolEntry) bool {
+	now := time.Now()
+	if p.MaxLifetime > 0 && now.Sub(e.createdAt) > p.MaxLifetime {
+		return true
+	}
+	if p.MaxIdleTime > 0 && now.Sub(e.lastUsedAt) > p.MaxIdleTime {
+		return true
+	}
+	return false
+}
+
+func (p *Pool) pastLifetimeLocked(e *poolEntry) bool {
+	return p.MaxLifetime > 0 && time.Since(e.createdAt) > p.MaxLifetime
+}
+
+func (p *Pool) wakeWaiterLocked() {
+	if len(p.waiters) == 0 {
+		return
+	}
+	w := p.waiters[0]
+	p.waiters = p.waiters[1:]
+	close(w)
+}
+
+// removeWaiterLocked removes w from the waiter queue and reports whether it
+// was still there. false means it was already popped (and woken) by a
+// concurrent wakeWaiterLocked.
+func (p *Pool) removeWaiterLocked(w chan struct{}) bool {
+	for i, x := range p.waiters {
+		if x == w {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Stats reports the pool's current usage.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return PoolStats{
+		InUse:        len(p.inUse),
+		Idle:         len(p.idle),
+		WaitCount:    p.waitCount,
+		WaitDuration: p.waitDuration,
+		Reconnects:   p.reconnects,
+	}
+}
+
+func (p *Pool) ensureHealthLoop() {
+	if p.HealthCheckInterval <= 0 {
+		return
+	}
+	p.startHealthLoop.Do(func() {
+		p.stopHealthLoop = make(chan struct{})
+		go p.healthLoop()
+	})
+}
+
+func (p *Pool) healthLoop() {
+	ticker := time.NewTicker(p.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.checkIdle()
+		case <-p.stopHealthLoop:
+			return
+		}
+	}
+}
+
+// checkIdle pings every currently idle connection and evicts any that fail
+// with a net error, so a connection that died while sitting idle isn't
+// handed out by the next Get. Each entry is popped out of p.idle under the
+// lock before it is pinged, so a concurrent Get can never hand the same
+// *Conn to a caller while checkIdle is still using it; a pinged entry that's
+// still healthy is pushed back onto p.idle afterward.
+func (p *Pool) checkIdle() {
+	p.mu.Lock()
+	claimed := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	for _, e := range claimed {
+		_, _, err := e.c.Raw.Query("SELECT 1")
+		p.mu.Lock()
+		if err != nil && e.c.isNetErr(err) {
+			p.numOpen--
+			p.wakeWaiterLocked()
+			p.mu.Unlock()
+			e.c.Raw.Close()
+			continue
+		}
+		p.idle = append(p.idle, e)
+		p.wakeWaiterLocked()
+		p.mu.Unlock()
+	}
+}
+
+// Close stops the background health checker and closes every idle
+// connection. Connections still checked out via Get are closed as they are
+// Put back. Any goroutine blocked in Get is woken with ErrPoolClosed instead
+// of being left to hang until its context expires.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	waiters := p.waiters
+	p.waiters = nil
+	if p.stopHealthLoop != nil {
+		close(p.stopHealthLoop)
+	}
+	p.mu.Unlock()
+
+	for _, w := range waiters {
+		close(w)
+	}
+
+	var firstErr error
+	for _, e := range idle {
+		if err := e.c.Raw.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Query checks out a connection, runs Conn.QueryContext on it, and returns
+// it to the pool, mirroring mysql.Conn.Query for callers who don't need to
+// hold a connection across multiple statements.
+func (p *Pool) Query(ctx context.Context, sql string, params ...interface{}) (rows []mysql.Row, res mysql.Result, err error) {
+	c, err := p.Get(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer p.Put(c)
+	return c.QueryContext(ctx, sql, params...)
+}
+
+// Exec prepares sql on a checked-out connection, runs it once with params,
+// and returns the connection to the pool. The prepared statement is
+// released from the connection's tracked set once Exec returns, since
+// Pool.Exec's per-call Prepare would otherwise grow that set without bound.
+func (p *Pool) Exec(ctx context.Context, sql string, params ...interface{}) (rows []mysql.Row, res mysql.Result, err error) {
+	c, err := p.Get(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer p.Put(c)
+	s, err := c.PrepareContext(ctx, sql)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer s.Close()
+	return s.ExecContext(ctx, params...)
+}
@@ -0,0 +1,112 @@
+package autorc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ziutek/mymysql/mysql"
+)
+
+// poolFakeConn is a minimal mysql.Conn for exercising Pool without a real
+// server. Close is tracked so tests can tell a discarded *Conn apart from a
+// recycled one.
+type poolFakeConn struct {
+	closed bool
+}
+
+func (f *poolFakeConn) Clone() mysql.Conn        { return &poolFakeConn{} }
+func (f *poolFakeConn) Connect() error           { return nil }
+func (f *poolFakeConn) Reconnect() error         { return nil }
+func (f *poolFakeConn) IsConnected() bool        { return true }
+func (f *poolFakeConn) Use(dbname string) error  { return nil }
+func (f *poolFakeConn) Register(sql string)      {}
+func (f *poolFakeConn) SetMaxPktSize(n int) int  { return n }
+func (f *poolFakeConn) SetTimeout(time.Duration) {}
+func (f *poolFakeConn) Escape(s string) string   { return s }
+func (f *poolFakeConn) ThreadId() uint32         { return 1 }
+
+func (f *poolFakeConn) Close() error {
+	f.closed = true
+	return nil
+}
+
+func (f *poolFakeConn) Query(sql string, params ...interface{}) ([]mysql.Row, mysql.Result, error) {
+	return nil, nil, nil
+}
+func (f *poolFakeConn) QueryFirst(sql string, params ...interface{}) (mysql.Row, mysql.Result, error) {
+	return nil, nil, nil
+}
+func (f *poolFakeConn) QueryLast(sql string, params ...interface{}) (mysql.Row, mysql.Result, error) {
+	return nil, nil, nil
+}
+func (f *poolFakeConn) Prepare(sql string) (mysql.Stmt, error) { return nil, nil }
+func (f *poolFakeConn) Begin() (mysql.Transaction, error)      { return nil, nil }
+
+func newTestPool(maxOpen, maxIdle int) *Pool {
+	return &Pool{
+		New:     func() *Conn { return &Conn{Raw: &poolFakeConn{}} },
+		MaxOpen: maxOpen,
+		MaxIdle: maxIdle,
+		inUse:   make(map[*Conn]*poolEntry),
+	}
+}
+
+// TestPoolGetPutRecyclesIdle verifies that a Conn returned via Put is handed
+// back out by the next Get instead of a new one being created.
+func TestPoolGetPutRecyclesIdle(t *testing.T) {
+	p := newTestPool(1, 1)
+	ctx := context.Background()
+
+	c1, err := p.Get(ctx)
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	p.Put(c1)
+
+	c2, err := p.Get(ctx)
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	if c2 != c1 {
+		t.Fatal("expected Put connection to be recycled by the next Get")
+	}
+}
+
+// TestPoolPutDiscardWakesWaiter verifies the fix where discarding a checked
+// out connection on Put (here: MaxIdle already full) still wakes a waiter
+// blocked in Get at MaxOpen, instead of leaving it stuck until ctx expires.
+func TestPoolPutDiscardWakesWaiter(t *testing.T) {
+	p := newTestPool(1, 0) // MaxIdle=0: every Put discards instead of idling
+	ctx := context.Background()
+
+	c1, err := p.Get(ctx)
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+
+	waiterErr := make(chan error, 1)
+	go func() {
+		waitCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_, err := p.Get(waitCtx)
+		waiterErr <- err
+	}()
+
+	// Give the waiter goroutine time to register before Put runs.
+	time.Sleep(20 * time.Millisecond)
+
+	p.Put(c1)
+	if !c1.Raw.(*poolFakeConn).closed {
+		t.Fatal("expected discarded connection to be closed")
+	}
+
+	select {
+	case err := <-waiterErr:
+		if err != nil {
+			t.Fatalf("waiting Get() = %v, want nil (slot should have been freed)", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("waiter was never woken after Put discarded the checked-out connection")
+	}
+}
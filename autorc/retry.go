@@ -0,0 +1,131 @@
+package autorc
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/ziutek/mymysql/mysql"
+)
+
+// ErrRetryUnsafe is returned instead of silently re-running a statement when
+// Conn.RetryMode is RetryReadOnly and the statement isn't read-only, or when
+// it is RetrySafe and autorc cannot confirm that the attempt which hit a net
+// error didn't already commit on the server.
+var ErrRetryUnsafe = errors.New("autorc: refusing to retry a non-idempotent statement after reconnect; see Conn.RetryMode")
+
+// ErrAlreadyCommitted is returned instead of re-running a statement when
+// Conn.RetryMode is RetrySafe and CheckFn confirms the attempt that hit the
+// net error already committed on the server. Unlike ErrRetryUnsafe, this
+// means the statement succeeded; CheckFn just has no way to hand back the
+// original rows/Result, so the call returns this sentinel with a nil
+// rows/Result instead of silently re-running (and duplicating) the write.
+var ErrAlreadyCommitted = errors.New("autorc: statement already committed before the connection dropped; not re-run")
+
+// RetryMode controls which statements autorc is willing to silently re-run
+// after a net error. A lost response doesn't mean the server never executed
+// the statement, so blindly retrying a write can duplicate it.
+type RetryMode int
+
+const (
+	// RetryAlways re-runs any statement on a net error. This is the
+	// historical autorc behavior and the zero value of RetryMode.
+	RetryAlways RetryMode = iota
+
+	// RetryReadOnly only re-runs statements recognized as read-only
+	// (SELECT/SHOW/EXPLAIN/...); anything else fails with ErrRetryUnsafe
+	// after the reconnect instead of risking a duplicate write.
+	RetryReadOnly
+
+	// RetrySafe re-runs read-only statements and statements marked
+	// Stmt.Idempotent unconditionally, and otherwise consults CheckFn to
+	// confirm the prior attempt didn't commit before retrying: returning
+	// ErrRetryUnsafe when it can't be sure, or ErrAlreadyCommitted when
+	// CheckFn confirms it already did.
+	RetrySafe
+)
+
+// CheckFn, when set, is consulted by RetrySafe before re-running a
+// statement that isn't read-only or marked idempotent. It runs against the
+// freshly reconnected connection (the original Transaction, if any, died
+// with the old connection) and reports whether the previous attempt already
+// committed.
+type CheckFn func(mysql.Conn) (done bool, err error)
+
+// retryVerdict is retryAllowed's answer for a statement that failed with a
+// net error: whether it's safe to silently re-run, and - for RetrySafe - a
+// separate signal for "don't re-run, it already succeeded" as opposed to
+// "don't re-run, we can't tell".
+type retryVerdict int
+
+const (
+	// retryRun re-runs the statement.
+	retryRun retryVerdict = iota
+	// retryUnsafe fails the call with ErrRetryUnsafe.
+	retryUnsafe
+	// retryAlreadyCommitted fails the call with ErrAlreadyCommitted: the
+	// prior attempt is confirmed to have committed, so retrying would
+	// duplicate it, but it did succeed.
+	retryAlreadyCommitted
+)
+
+// retryAllowed reports how a statement that failed with a net error should
+// be handled, per c.RetryMode.
+func (c *Conn) retryAllowed(sql string, idempotent bool) retryVerdict {
+	switch c.RetryMode {
+	case RetryReadOnly:
+		if isReadOnlySQL(sql) {
+			return retryRun
+		}
+		return retryUnsafe
+	case RetrySafe:
+		if idempotent || isReadOnlySQL(sql) {
+			return retryRun
+		}
+		if c.CheckFn == nil {
+			return retryUnsafe
+		}
+		done, err := c.CheckFn(c.Raw)
+		if err != nil {
+			return retryUnsafe
+		}
+		if done {
+			return retryAlreadyCommitted
+		}
+		return retryRun
+	default:
+		return retryRun
+	}
+}
+
+var readOnlyKeywords = []string{"SELECT", "SHOW", "EXPLAIN", "DESCRIBE", "DESC"}
+
+// lockingClauses marks a leading SELECT as not actually read-only: it takes
+// row locks on the server just like a write, so retrying it after a net
+// error risks the same double-execution (here, a held lock, or a second
+// locking read racing the first) that RetryReadOnly/RetrySafe exist to
+// avoid.
+var lockingClauses = []string{"FOR UPDATE", "LOCK IN SHARE MODE"}
+
+// isReadOnlySQL reports whether sql looks like a read-only statement, based
+// on its leading keyword - except a SELECT ... FOR UPDATE or LOCK IN SHARE
+// MODE, which takes locks and so isn't safe to blindly re-run either.
+func isReadOnlySQL(sql string) bool {
+	s := strings.TrimLeft(sql, " \t\r\n(")
+	matched := false
+	for _, kw := range readOnlyKeywords {
+		if len(s) >= len(kw) && strings.EqualFold(s[:len(kw)], kw) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return false
+	}
+	upper := strings.ToUpper(s)
+	for _, clause := range lockingClauses {
+		if strings.Contains(upper, clause) {
+			return false
+		}
+	}
+	return true
+}
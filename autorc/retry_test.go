@@ -0,0 +1,138 @@
+package autorc
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/ziutek/mymysql/mysql"
+)
+
+// retryFakeConn is a minimal mysql.Conn whose Query fails once with a net
+// error and then succeeds, so tests can drive a Conn through exactly one
+// reconnect.
+type retryFakeConn struct {
+	queryErrs   []error
+	reconnected bool
+}
+
+func (f *retryFakeConn) Clone() mysql.Conn                { return &retryFakeConn{} }
+func (f *retryFakeConn) Connect() error                   { return nil }
+func (f *retryFakeConn) Close() error                     { return nil }
+func (f *retryFakeConn) IsConnected() bool                { return true }
+func (f *retryFakeConn) Use(dbname string) error          { return nil }
+func (f *retryFakeConn) Register(sql string)              {}
+func (f *retryFakeConn) SetMaxPktSize(n int) int          { return n }
+func (f *retryFakeConn) SetTimeout(timeout time.Duration) {}
+func (f *retryFakeConn) Escape(s string) string           { return s }
+func (f *retryFakeConn) ThreadId() uint32                 { return 1 }
+
+func (f *retryFakeConn) Prepare(sql string) (mysql.Stmt, error) { return nil, nil }
+func (f *retryFakeConn) Begin() (mysql.Transaction, error)      { return nil, nil }
+
+func (f *retryFakeConn) Reconnect() error {
+	f.reconnected = true
+	return nil
+}
+
+func (f *retryFakeConn) Query(sql string, params ...interface{}) ([]mysql.Row, mysql.Result, error) {
+	if len(f.queryErrs) == 0 {
+		return nil, nil, nil
+	}
+	err := f.queryErrs[0]
+	f.queryErrs = f.queryErrs[1:]
+	return nil, nil, err
+}
+
+func (f *retryFakeConn) QueryFirst(sql string, params ...interface{}) (mysql.Row, mysql.Result, error) {
+	return nil, nil, nil
+}
+
+func (f *retryFakeConn) QueryLast(sql string, params ...interface{}) (mysql.Row, mysql.Result, error) {
+	return nil, nil, nil
+}
+
+func TestIsReadOnlySQL(t *testing.T) {
+	cases := map[string]bool{
+		"SELECT 1":                           true,
+		"  select * from t":                  true,
+		"(SELECT 1)":                         true,
+		"SHOW TABLES":                        true,
+		"EXPLAIN SELECT 1":                   true,
+		"SELECT * FROM t FOR UPDATE":         false,
+		"select * from t lock in share mode": false,
+		"INSERT INTO t VALUES()":             false,
+		"UPDATE t SET a=1":                   false,
+		"DELETE FROM t":                      false,
+	}
+	for sql, want := range cases {
+		if got := isReadOnlySQL(sql); got != want {
+			t.Errorf("isReadOnlySQL(%q) = %v, want %v", sql, got, want)
+		}
+	}
+}
+
+// TestRetrySafeChecksAfterReconnect verifies that CheckFn is consulted on
+// the freshly reconnected connection, not the dead one: a CheckFn that
+// reports "not done" only once c.Raw has been reconnected must actually
+// observe the reconnect before Query retries and succeeds.
+func TestRetrySafeChecksAfterReconnect(t *testing.T) {
+	raw := &retryFakeConn{queryErrs: []error{io.ErrUnexpectedEOF}}
+	c := &Conn{
+		Raw:        raw,
+		MaxRetries: 1,
+		RetryMode:  RetrySafe,
+		CheckFn: func(conn mysql.Conn) (bool, error) {
+			if !raw.reconnected {
+				t.Fatal("CheckFn ran before the connection was reconnected")
+			}
+			return false, nil
+		},
+	}
+	if _, _, err := c.Query("INSERT INTO t VALUES (1)"); err != nil {
+		t.Fatalf("Query() = %v, want nil", err)
+	}
+	if !raw.reconnected {
+		t.Fatal("expected Reconnect to have been called")
+	}
+}
+
+// TestRetrySafeAlreadyCommitted verifies that a CheckFn confirming the
+// prior attempt already committed fails the call with ErrAlreadyCommitted
+// rather than silently re-running (and duplicating) the write or returning
+// the "can't tell" ErrRetryUnsafe.
+func TestRetrySafeAlreadyCommitted(t *testing.T) {
+	raw := &retryFakeConn{queryErrs: []error{io.ErrUnexpectedEOF}}
+	c := &Conn{
+		Raw:        raw,
+		MaxRetries: 1,
+		RetryMode:  RetrySafe,
+		CheckFn: func(conn mysql.Conn) (bool, error) {
+			return true, nil
+		},
+	}
+	_, _, err := c.Query("INSERT INTO t VALUES (1)")
+	if err != ErrAlreadyCommitted {
+		t.Fatalf("Query() err = %v, want ErrAlreadyCommitted", err)
+	}
+}
+
+// TestRetrySafeUnsafeWhenCheckFnFails verifies that a CheckFn error - we
+// genuinely can't tell whether the prior attempt committed - fails the call
+// with ErrRetryUnsafe.
+func TestRetrySafeUnsafeWhenCheckFnFails(t *testing.T) {
+	raw := &retryFakeConn{queryErrs: []error{io.ErrUnexpectedEOF}}
+	c := &Conn{
+		Raw:        raw,
+		MaxRetries: 1,
+		RetryMode:  RetrySafe,
+		CheckFn: func(conn mysql.Conn) (bool, error) {
+			return false, errors.New("check query failed")
+		},
+	}
+	_, _, err := c.Query("INSERT INTO t VALUES (1)")
+	if err != ErrRetryUnsafe {
+		t.Fatalf("Query() err = %v, want ErrRetryUnsafe", err)
+	}
+}
@@ -0,0 +1,136 @@
+package autorc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/ziutek/mymysql/mysql"
+)
+
+// sessionState tracks per-connection state that a freshly reestablished
+// mysql.Conn won't have after reconnectIfNetErr: the selected database, any
+// variables set via Conn.Set, arbitrary replay hooks registered with
+// Conn.OnReconnect, and every live *Stmt created through Prepare/
+// PrepareOnce so they can all be re-prepared in one pass instead of one at
+// a time via ER_UNKNOWN_STMT_HANDLER.
+type sessionState struct {
+	mu    sync.Mutex
+	db    string
+	vars  map[string]string
+	hooks []func(mysql.Conn) error
+	// stmts is not weak - a *Stmt stays tracked (and gets re-prepared on
+	// every future reconnect) until it is explicitly released via
+	// Stmt.Close. Fine for the common case of a handful of statements
+	// prepared once and reused for the life of the Conn; callers that
+	// prepare short-lived statements (e.g. Pool.Exec) must Close them.
+	stmts map[*Stmt]struct{}
+}
+
+func (c *Conn) sessionFor() *sessionState {
+	if c.session == nil {
+		c.session = &sessionState{}
+	}
+	return c.session
+}
+
+// Set runs "SET SESSION name=value" on the connection and records it so it
+// is replayed automatically after any future reconnect.
+func (c *Conn) Set(name, value string) error {
+	if _, _, err := c.Query(fmt.Sprintf("SET SESSION %s=%s", name, value)); err != nil {
+		return err
+	}
+	s := c.sessionFor()
+	s.mu.Lock()
+	if s.vars == nil {
+		s.vars = make(map[string]string)
+	}
+	s.vars[name] = value
+	s.mu.Unlock()
+	return nil
+}
+
+// OnReconnect registers f to run every time the connection is reestablished
+// after a net error, after session variables and prepared statements have
+// already been replayed. Use it for state autorc doesn't track itself, such
+// as temporary tables or user-defined variables.
+func (c *Conn) OnReconnect(f func(mysql.Conn) error) {
+	s := c.sessionFor()
+	s.mu.Lock()
+	s.hooks = append(s.hooks, f)
+	s.mu.Unlock()
+}
+
+func (c *Conn) recordUse(dbname string) {
+	s := c.sessionFor()
+	s.mu.Lock()
+	s.db = dbname
+	s.mu.Unlock()
+}
+
+func (c *Conn) trackStmt(s *Stmt) {
+	st := c.sessionFor()
+	st.mu.Lock()
+	if st.stmts == nil {
+		st.stmts = make(map[*Stmt]struct{})
+	}
+	st.stmts[s] = struct{}{}
+	st.mu.Unlock()
+}
+
+// untrackStmt removes s from the set of statements replayed after a
+// reconnect. See Stmt.Close.
+func (c *Conn) untrackStmt(s *Stmt) {
+	if c.session == nil {
+		return
+	}
+	st := c.session
+	st.mu.Lock()
+	delete(st.stmts, s)
+	st.mu.Unlock()
+}
+
+// replaySession restores everything sessionState knows about onto a freshly
+// reconnected c.Raw: the selected database, recorded SET SESSION
+// variables, every live prepared statement, and finally any OnReconnect
+// hooks, in that order.
+func (c *Conn) replaySession() error {
+	if c.session == nil {
+		return nil
+	}
+	s := c.session
+	s.mu.Lock()
+	db := s.db
+	vars := make(map[string]string, len(s.vars))
+	for name, value := range s.vars {
+		vars[name] = value
+	}
+	stmts := make([]*Stmt, 0, len(s.stmts))
+	for stmt := range s.stmts {
+		stmts = append(stmts, stmt)
+	}
+	hooks := append([]func(mysql.Conn) error(nil), s.hooks...)
+	s.mu.Unlock()
+
+	if db != "" {
+		if err := c.Raw.Use(db); err != nil {
+			return err
+		}
+	}
+	for name, value := range vars {
+		if _, _, err := c.Raw.Query(fmt.Sprintf("SET SESSION %s=%s", name, value)); err != nil {
+			return err
+		}
+	}
+	for _, stmt := range stmts {
+		if err := c.reprepare(context.Background(), stmt); err != nil {
+			return err
+		}
+	}
+	for _, hook := range hooks {
+		if err := hook(c.Raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}